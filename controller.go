@@ -0,0 +1,589 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/pmezard/go-difflib/difflib"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corev1apply "k8s.io/client-go/applyconfigurations/core/v1"
+	metav1apply "k8s.io/client-go/applyconfigurations/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/GregSharpe1/thanos-limits-controller/internal/metamonitoring"
+	"github.com/GregSharpe1/thanos-limits-controller/internal/retry"
+)
+
+// reconcileKey is the only item ever placed on the workqueue. The controller
+// reconciles the aggregate state of every matching StatefulSet against the
+// source ConfigMap, so there's no per-object key to track - any watched
+// event just needs to trigger "reconcile everything again".
+const reconcileKey = "reconcile"
+
+// Controller watches StatefulSets (matching labelSelector) and the source
+// ConfigMap, and regenerates the limits ConfigMap whenever either changes.
+// Informers only drive *when* to reconcile; the reconcile itself still talks
+// to the API server directly so the computed limits are never stale against
+// a lagging local cache.
+type Controller struct {
+	Clientset *kubernetes.Clientset
+	Namespace string
+
+	cmdConfig     CmdConfig
+	labelSelector labels.Selector
+
+	informerFactory informers.SharedInformerFactory
+	stsSynced       cache.InformerSynced
+	cmSynced        cache.InformerSynced
+
+	queue  workqueue.RateLimitingInterface
+	health *health
+
+	// log carries the fields stable across every reconcile (namespace,
+	// configmap). reconcile adds reconcileID, replicas and globalLimit to its
+	// own log entries only; the helpers it calls log through this field, so
+	// their lines carry namespace and configmap but no reconcileID.
+	log              *log.Entry
+	reconcileCounter uint64
+}
+
+func NewController(cmdConfig CmdConfig, rawLabelSelector string) (*Controller, error) {
+	clientset, err := getKubernetesClient()
+	if err != nil {
+		return nil, err
+	}
+
+	namespace, err := getCurrentNamespace()
+	if err != nil {
+		return nil, err
+	}
+
+	selector, err := labels.Parse(rawLabelSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -statefulset-label %q: %w", rawLabelSelector, err)
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, cmdConfig.ResyncPeriod,
+		informers.WithNamespace(namespace))
+
+	c := &Controller{
+		Clientset:       clientset,
+		Namespace:       namespace,
+		cmdConfig:       cmdConfig,
+		labelSelector:   selector,
+		informerFactory: factory,
+		queue:           workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		health:          newHealth(2 * cmdConfig.ResyncPeriod),
+		log: log.WithFields(log.Fields{
+			"namespace": namespace,
+			"configmap": cmdConfig.ConfigMapName,
+		}),
+	}
+
+	stsInformer := factory.Apps().V1().StatefulSets().Informer()
+	stsInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.enqueueOnStatefulSetEvent(obj) },
+		UpdateFunc: func(old, new interface{}) { c.enqueueOnStatefulSetUpdate(old, new) },
+		DeleteFunc: func(obj interface{}) { c.enqueueOnStatefulSetEvent(obj) },
+	})
+	c.stsSynced = stsInformer.HasSynced
+
+	cmInformer := factory.Core().V1().ConfigMaps().Informer()
+	cmInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.enqueueOnSourceConfigMapEvent(obj) },
+		UpdateFunc: func(_, obj interface{}) { c.enqueueOnSourceConfigMapEvent(obj) },
+	})
+	c.cmSynced = cmInformer.HasSynced
+
+	return c, nil
+}
+
+// toStatefulSet unwraps a cache.DeletedFinalStateUnknown tombstone (delivered
+// when a delete is missed and only later observed via relist) so deletes are
+// never silently dropped.
+func toStatefulSet(obj interface{}) (*appsv1.StatefulSet, bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	sts, ok := obj.(*appsv1.StatefulSet)
+	return sts, ok
+}
+
+func (c *Controller) enqueueOnStatefulSetEvent(obj interface{}) {
+	sts, ok := toStatefulSet(obj)
+	if !ok {
+		return
+	}
+	if !c.labelSelector.Matches(labels.Set(sts.Labels)) {
+		return
+	}
+	c.log.WithField("statefulset", sts.Name).Debug("enqueuing reconcile: StatefulSet changed")
+	c.queue.Add(reconcileKey)
+}
+
+// enqueueOnStatefulSetUpdate enqueues a reconcile if the StatefulSet matches
+// the label selector either before or after the update, so a StatefulSet
+// losing the selector label (e.g. during a relabel) still
+// triggers a recompute instead of being silently ignored.
+func (c *Controller) enqueueOnStatefulSetUpdate(oldObj, newObj interface{}) {
+	oldSts, oldOK := toStatefulSet(oldObj)
+	newSts, newOK := toStatefulSet(newObj)
+
+	matched := (oldOK && c.labelSelector.Matches(labels.Set(oldSts.Labels))) ||
+		(newOK && c.labelSelector.Matches(labels.Set(newSts.Labels)))
+	if !matched {
+		return
+	}
+
+	name := ""
+	if newOK {
+		name = newSts.Name
+	} else {
+		name = oldSts.Name
+	}
+	c.log.WithField("statefulset", name).Debug("enqueuing reconcile: StatefulSet changed")
+	c.queue.Add(reconcileKey)
+}
+
+func (c *Controller) enqueueOnSourceConfigMapEvent(obj interface{}) {
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		return
+	}
+	if cm.Name != c.cmdConfig.ConfigMapName {
+		return
+	}
+	c.log.Debug("enqueuing reconcile: source ConfigMap changed")
+	c.queue.Add(reconcileKey)
+}
+
+// Run starts the informers and processes the workqueue until ctx is
+// cancelled. If cmdConfig.LeaderElect is set, reconciliation only happens
+// while this process holds the Lease, so multiple replicas can run HA
+// without racing on the generated ConfigMap; Run then also returns, with a
+// nil error, once this process stops holding the Lease.
+func (c *Controller) Run(ctx context.Context) error {
+	if !c.cmdConfig.LeaderElect {
+		c.health.setLeading(true)
+		return c.runLeading(ctx)
+	}
+
+	identity, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("failed to determine leader-election identity: %w", err)
+	}
+
+	lock, err := resourcelock.New(
+		resourcelock.LeasesResourceLock,
+		c.Namespace,
+		c.cmdConfig.LeaderElectionLeaseName,
+		c.Clientset.CoreV1(),
+		c.Clientset.CoordinationV1(),
+		resourcelock.ResourceLockConfig{Identity: identity},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create leader-election lock: %w", err)
+	}
+
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		ReleaseOnCancel: true,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leaderCtx context.Context) {
+				c.log.WithField("identity", identity).Info("started leading")
+				c.health.setLeading(true)
+				if err := c.runLeading(leaderCtx); err != nil && leaderCtx.Err() == nil {
+					c.log.WithError(err).Error("controller loop exited with error")
+				}
+			},
+			OnStoppedLeading: func() {
+				c.log.WithField("identity", identity).Info("stopped leading")
+				c.health.setLeading(false)
+			},
+			OnNewLeader: func(current string) {
+				if current != identity {
+					c.log.WithField("leader", current).Debug("new leader elected")
+				}
+			},
+		},
+	})
+
+	return nil
+}
+
+// runLeading starts the informers and workqueue workers. It blocks until ctx
+// is cancelled.
+func (c *Controller) runLeading(ctx context.Context) error {
+	defer c.queue.ShutDown()
+
+	c.informerFactory.Start(ctx.Done())
+
+	if !cache.WaitForCacheSync(ctx.Done(), c.stsSynced, c.cmSynced) {
+		return fmt.Errorf("timed out waiting for informer caches to sync")
+	}
+
+	// Reconcile once up front so that state at startup (before any informer
+	// event fires) isn't left stale.
+	c.queue.Add(reconcileKey)
+
+	go c.runWorker(ctx)
+
+	<-ctx.Done()
+	return nil
+}
+
+func (c *Controller) runWorker(ctx context.Context) {
+	for c.processNextWorkItem(ctx) {
+	}
+}
+
+func (c *Controller) processNextWorkItem(ctx context.Context) bool {
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.reconcile(ctx); err != nil {
+		c.log.WithError(err).Error("reconcile failed, requeuing")
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	c.queue.Forget(key)
+	return true
+}
+
+// reconcile recomputes the global head_series_limit from the currently
+// running StatefulSets and writes it into the generated ConfigMap.
+func (c *Controller) reconcile(ctx context.Context) (err error) {
+	start := time.Now()
+	reconcileID := strconv.FormatUint(atomic.AddUint64(&c.reconcileCounter, 1), 10)
+	entry := c.log.WithField("reconcileID", reconcileID)
+
+	defer func() {
+		reconcileDuration.Observe(time.Since(start).Seconds())
+		switch {
+		case errors.Is(err, ErrLimitsDiffer):
+			// Expected outcome of -diff mode, not a reconcile failure.
+			reconcileTotal.WithLabelValues("diff").Inc()
+			entry.Debug("reconcile detected a diff against the live limits")
+		case err != nil:
+			reconcileTotal.WithLabelValues("error").Inc()
+			entry.WithError(err).Error("reconcile failed")
+		default:
+			reconcileTotal.WithLabelValues("success").Inc()
+			c.health.recordSuccess(start)
+			entry.Debug("reconcile succeeded")
+		}
+	}()
+
+	labelSelector := c.cmdConfig.ReceiverLabel
+
+	runningReplicas, err := c.getRunningStatefulSets(labelSelector)
+	if err != nil {
+		return fmt.Errorf("error listing StatefulSets: %w", err)
+	}
+	runningReplicasGauge.Set(float64(runningReplicas))
+	entry = entry.WithField("replicas", runningReplicas)
+
+	globalLimit := runningReplicas * c.cmdConfig.ActiveSeriesMax
+	headSeriesLimitGauge.Set(float64(globalLimit))
+	entry = entry.WithField("globalLimit", globalLimit)
+	entry.Debug("calculated global head_series_limit")
+
+	limitsConfig, sourceConfigMap, err := c.getLimitsConfigMap(c.cmdConfig.ConfigMapName, c.cmdConfig.ConfigMapLimitsPath)
+	if err != nil {
+		return fmt.Errorf("error fetching the configmap %s: %w", c.cmdConfig.ConfigMapName, err)
+	}
+
+	if c.cmdConfig.MetaMonitoringURL != "" {
+		if err = c.applyTenantHeadSeriesLimits(ctx, limitsConfig, runningReplicas); err != nil {
+			return fmt.Errorf("failed to compute per-tenant head_series_limit: %w", err)
+		}
+	}
+
+	if err = c.createGeneratedConfigMap(c.cmdConfig.ConfigMapGeneratedName, c.cmdConfig.ConfigMapLimitsPath, limitsConfig, globalLimit, sourceConfigMap); err != nil {
+		if errors.Is(err, ErrLimitsDiffer) {
+			return err
+		}
+		configMapApplyErrors.Inc()
+		return fmt.Errorf("failed to create or update configmap: %w", err)
+	}
+
+	return nil
+}
+
+// applyTenantHeadSeriesLimits queries the meta-monitoring endpoint for
+// current active series per tenant and sets each tenant's head_series_limit
+// to min(active*ratio, runningReplicas*ActiveSeriesMax). Tenants already
+// present in limitsConfig are merged in place - their other fields (e.g.
+// Request) are left untouched, and tenants missing from the query result
+// are left as-is.
+func (c *Controller) applyTenantHeadSeriesLimits(ctx context.Context, limitsConfig *WriteConfig, runningReplicas int) error {
+	activeByTenant, err := metamonitoring.QueryActiveSeriesByTenant(ctx, c.cmdConfig.MetaMonitoringURL, c.cmdConfig.MetaMonitoringQuery)
+	if err != nil {
+		return err
+	}
+
+	if limitsConfig.Write.Tenant == nil {
+		limitsConfig.Write.Tenant = make(map[string]*TenantConfig, len(activeByTenant))
+	}
+
+	replicaMax := runningReplicas * c.cmdConfig.ActiveSeriesMax
+
+	for tenant, active := range activeByTenant {
+		limit := int(active * c.cmdConfig.TenantHeadroomRatio)
+		if limit > replicaMax {
+			limit = replicaMax
+		}
+
+		tenantConfig, exists := limitsConfig.Write.Tenant[tenant]
+		if !exists || tenantConfig == nil {
+			// A tenant key present with an explicit null value (tenants:\n  foo:)
+			// parses via yaml.v2 as a nil *TenantConfig, not a missing key.
+			tenantConfig = &TenantConfig{}
+			limitsConfig.Write.Tenant[tenant] = tenantConfig
+		}
+		tenantConfig.HeadSeriesLimit = &limit
+
+		c.log.WithFields(log.Fields{
+			"tenant":          tenant,
+			"activeSeries":    active,
+			"headSeriesLimit": limit,
+		}).Debug("resolved per-tenant head_series_limit")
+	}
+
+	return nil
+}
+
+// getKubernetesClient creates a Kubernetes clientset
+func getKubernetesClient() (*kubernetes.Clientset, error) {
+	var config *rest.Config
+	var err error
+
+	// Try in-cluster config first
+	config, err = rest.InClusterConfig()
+	if err != nil {
+		// Fall back to kubeconfig
+		log.Debug("Not running in cluster, using kubeconfig")
+		kubeconfig := filepath.Join(os.Getenv("HOME"), ".kube", "config")
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("error building kubeconfig: %v", err)
+		}
+	}
+
+	return kubernetes.NewForConfig(config)
+}
+
+func getCurrentNamespace() (string, error) {
+	// Try to get namespace from service account
+	data, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	if err == nil {
+		return string(data), nil
+	}
+
+	// If not running in a pod, check if NAMESPACE env var is set
+	namespace := os.Getenv("NAMESPACE")
+	if namespace != "" {
+		return namespace, nil
+	}
+
+	// Otherwise, use the current context's namespace from kubeconfig
+	kubeconfig := filepath.Join(os.Getenv("HOME"), ".kube", "config")
+	config, err := clientcmd.LoadFromFile(kubeconfig)
+	if err != nil {
+		return "default", nil // Default to "default" namespace as last resort
+	}
+
+	context := config.Contexts[config.CurrentContext]
+	if context != nil && context.Namespace != "" {
+		return context.Namespace, nil
+	}
+
+	return "default", nil
+}
+
+// getRunningStatefulSets returns the number of ready replicas for statefulsets matching a label.
+func (c *Controller) getRunningStatefulSets(labelSelector string) (int, error) {
+	// List StatefulSets with the given label, retrying on transient API errors.
+	var statefulSets *appsv1.StatefulSetList
+	err := retry.Do(context.TODO(), retry.DefaultBackoff, func() error {
+		var listErr error
+		statefulSets, listErr = c.Clientset.AppsV1().StatefulSets(c.Namespace).List(context.TODO(), metav1.ListOptions{
+			LabelSelector: labelSelector,
+		})
+		return listErr
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Then sum the ready replicas of every listed StatefulSet (partly ready ones included)
+	var runningReplicas int32
+	for _, sts := range statefulSets.Items {
+		runningReplicas += sts.Status.ReadyReplicas
+		c.log.WithFields(log.Fields{
+			"statefulset":   sts.Name,
+			"readyReplicas": sts.Status.ReadyReplicas,
+			"replicas":      sts.Status.Replicas,
+		}).Debug("StatefulSet replica status")
+	}
+
+	return int(runningReplicas), nil
+}
+
+func (c *Controller) getLimitsConfigMap(configMapName string, configMapPath string) (*WriteConfig, *corev1.ConfigMap, error) {
+
+	var configMapData *corev1.ConfigMap
+	err := retry.Do(context.TODO(), retry.DefaultBackoff, func() error {
+		var getErr error
+		configMapData, getErr = c.Clientset.CoreV1().ConfigMaps(c.Namespace).Get(context.TODO(), configMapName, metav1.GetOptions{})
+		return getErr
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error locating ConfigMap: %v", err)
+	}
+
+	limitsConfig, exists := configMapData.Data[configMapPath]
+	if !exists {
+		return nil, nil, fmt.Errorf("key %s not fond in ConfigMap %s", configMapPath, configMapName)
+	}
+
+	var parsedConfig WriteConfig
+	unmarshalErr := yaml.Unmarshal([]byte(limitsConfig), &parsedConfig)
+	if unmarshalErr != nil {
+		return nil, nil, fmt.Errorf("failed to parse limits config: %w", unmarshalErr)
+	}
+
+	return &parsedConfig, configMapData, nil
+}
+
+// fieldManager identifies this controller's writes in server-side apply, so
+// it only ever owns the fields it actually computes.
+const fieldManager = "thanos-limits-controller"
+
+// ErrLimitsDiffer is returned by createGeneratedConfigMap in -diff mode when
+// the computed limits don't match what's currently live.
+var ErrLimitsDiffer = errors.New("computed limits differ from the live generated ConfigMap")
+
+// liveGeneratedConfigMapYAML returns the currently stored YAML for
+// configMapPath in the generated ConfigMap, or "" if it doesn't exist yet.
+func (c *Controller) liveGeneratedConfigMapYAML(configMapGeneratedName, configMapPath string) (string, error) {
+	var existing *corev1.ConfigMap
+	err := retry.Do(context.TODO(), retry.DefaultBackoff, func() error {
+		var getErr error
+		existing, getErr = c.Clientset.CoreV1().ConfigMaps(c.Namespace).Get(context.TODO(), configMapGeneratedName, metav1.GetOptions{})
+		return getErr
+	})
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return existing.Data[configMapPath], nil
+}
+
+// createGeneratedConfigMap server-side applies the generated limits
+// ConfigMap, owned by sourceConfigMap so it's garbage-collected when the
+// source is deleted. Using apply instead of create-then-update means the
+// controller never needs to round-trip a ResourceVersion. Note the whole
+// rendered config.yaml value is applied as one opaque string with Force:
+// true, so this controller owns that entire key every reconcile - a hand
+// edit to it on the generated ConfigMap will be overwritten, not merged.
+//
+// In -dry-run mode it logs the computed YAML and a diff against what's live
+// but never writes anything. In -diff mode it additionally returns
+// ErrLimitsDiffer when the two differ, so callers can exit non-zero.
+func (c *Controller) createGeneratedConfigMap(configMapGeneratedName string, configMapPath string, config *WriteConfig, headSeriesValue int, sourceConfigMap *corev1.ConfigMap) error {
+
+	config.Write.Default.HeadSeriesLimit = &headSeriesValue
+
+	updatedYAML, err := yaml.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to marshal updated config: %w", err)
+	}
+
+	if c.cmdConfig.DryRun || c.cmdConfig.Diff {
+		c.log.Infof("computed limits for ConfigMap %s:\n%s", configMapGeneratedName, updatedYAML)
+
+		liveYAML, err := c.liveGeneratedConfigMapYAML(configMapGeneratedName, configMapPath)
+		if err != nil {
+			return fmt.Errorf("failed to fetch live ConfigMap %s for diff: %w", configMapGeneratedName, err)
+		}
+
+		if liveYAML == string(updatedYAML) {
+			c.log.WithField("generatedConfigmap", configMapGeneratedName).Info("no diff between computed and live limits")
+			return nil
+		}
+
+		unifiedDiff := difflib.UnifiedDiff{
+			A:        difflib.SplitLines(liveYAML),
+			B:        difflib.SplitLines(string(updatedYAML)),
+			FromFile: "live/" + configMapGeneratedName,
+			ToFile:   "computed/" + configMapGeneratedName,
+			Context:  3,
+		}
+		diffText, diffErr := difflib.GetUnifiedDiffString(unifiedDiff)
+		if diffErr != nil {
+			return fmt.Errorf("failed to compute diff: %w", diffErr)
+		}
+		c.log.Infof("computed limits differ from live ConfigMap %s:\n%s", configMapGeneratedName, diffText)
+
+		if c.cmdConfig.Diff {
+			return ErrLimitsDiffer
+		}
+
+		c.log.WithField("generatedConfigmap", configMapGeneratedName).Info("dry-run: not applying ConfigMap")
+		return nil
+	}
+
+	applyConfig := corev1apply.ConfigMap(configMapGeneratedName, c.Namespace).
+		WithOwnerReferences(metav1apply.OwnerReference().
+			WithAPIVersion("v1").
+			WithKind("ConfigMap").
+			WithName(sourceConfigMap.Name).
+			WithUID(sourceConfigMap.UID).
+			WithController(true).
+			WithBlockOwnerDeletion(true)).
+		WithData(map[string]string{configMapPath: string(updatedYAML)})
+
+	applyErr := retry.Do(context.TODO(), retry.DefaultBackoff, func() error {
+		_, err := c.Clientset.CoreV1().ConfigMaps(c.Namespace).Apply(context.TODO(), applyConfig, metav1.ApplyOptions{
+			FieldManager: fieldManager,
+			Force:        true,
+		})
+		return err
+	})
+	if applyErr != nil {
+		return fmt.Errorf("failed to apply ConfigMap %s: %w", configMapGeneratedName, applyErr)
+	}
+
+	c.log.WithField("generatedConfigmap", configMapGeneratedName).Info("Successfully applied ConfigMap")
+	return nil
+}
@@ -0,0 +1,48 @@
+// Package metamonitoring queries a Prometheus/Thanos meta-monitoring
+// endpoint for current active series per tenant, mirroring the
+// meta_monitoring_url / meta_monitoring_limit_query fields Thanos Receive
+// already understands in its own write config.
+package metamonitoring
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	promapi "github.com/prometheus/client_golang/api"
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// QueryActiveSeriesByTenant runs query as an instant query against url and
+// returns active series counts keyed by each result's "tenant" label.
+// Results without a tenant label are ignored.
+func QueryActiveSeriesByTenant(ctx context.Context, url, query string) (map[string]float64, error) {
+	client, err := promapi.NewClient(promapi.Config{Address: url})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create meta-monitoring client: %w", err)
+	}
+
+	api := promv1.NewAPI(client)
+
+	result, _, err := api.Query(ctx, query, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("meta-monitoring query failed: %w", err)
+	}
+
+	vector, ok := result.(model.Vector)
+	if !ok {
+		return nil, fmt.Errorf("unexpected meta-monitoring result type %T, expected a vector", result)
+	}
+
+	activeByTenant := make(map[string]float64, len(vector))
+	for _, sample := range vector {
+		tenant := string(sample.Metric["tenant"])
+		if tenant == "" {
+			continue
+		}
+		activeByTenant[tenant] = float64(sample.Value)
+	}
+
+	return activeByTenant, nil
+}
@@ -0,0 +1,85 @@
+// Package retry wraps Kubernetes API calls with exponential backoff so that
+// transient API-server errors (throttling, timeouts, restarts) don't
+// immediately bubble up and take the controller down with them.
+package retry
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Backoff describes an exponential backoff with jitter.
+type Backoff struct {
+	// Steps is the maximum number of attempts, including the first.
+	Steps int
+	// Duration is the base delay between the first and second attempt.
+	Duration time.Duration
+	// Factor is the multiplier applied to Duration after each attempt.
+	Factor float64
+	// Jitter is the fraction (0-1) of randomness added to each delay.
+	Jitter float64
+}
+
+// DefaultBackoff makes up to 5 attempts (4 retries), starting at 200ms and doubling,
+// which spreads the final attempt roughly 3s after the first.
+var DefaultBackoff = Backoff{
+	Steps:    5,
+	Duration: 200 * time.Millisecond,
+	Factor:   2.0,
+	Jitter:   0.1,
+}
+
+// Retryable reports whether err is a transient API-server error worth
+// retrying rather than surfacing to the caller.
+func Retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	return apierrors.IsServerTimeout(err) ||
+		apierrors.IsTooManyRequests(err) ||
+		apierrors.IsInternalError(err) ||
+		apierrors.IsServiceUnavailable(err)
+}
+
+// Do calls fn until it succeeds, returns a non-retryable error, or backoff
+// is exhausted, whichever comes first. The last error fn returned is
+// returned unwrapped so callers can still inspect/wrap it themselves. If ctx
+// is cancelled while waiting between attempts, ctx.Err() is returned instead.
+func Do(ctx context.Context, backoff Backoff, fn func() error) error {
+	wait := backoff.Duration
+
+	var lastErr error
+	for attempt := 0; attempt < backoff.Steps; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(jittered(wait, backoff.Jitter)):
+			}
+			wait = time.Duration(float64(wait) * backoff.Factor)
+		}
+
+		lastErr = fn()
+		if lastErr == nil {
+			return nil
+		}
+		if !Retryable(lastErr) {
+			return lastErr
+		}
+	}
+
+	return lastErr
+}
+
+func jittered(d time.Duration, factor float64) time.Duration {
+	if factor <= 0 {
+		return d
+	}
+	delta := factor * float64(d)
+	lo := float64(d) - delta
+	hi := float64(d) + delta
+	return time.Duration(lo + (hi-lo)*rand.Float64())
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	reconcileTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tlc_reconcile_total",
+		Help: "Total number of reconciles, by result.",
+	}, []string{"result"})
+
+	reconcileDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "tlc_reconcile_duration_seconds",
+		Help: "Time taken to complete a reconcile.",
+	})
+
+	runningReplicasGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tlc_running_replicas",
+		Help: "Number of running receive replicas matched by -statefulset-label.",
+	})
+
+	headSeriesLimitGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tlc_head_series_limit",
+		Help: "Most recently computed global write.default.head_series_limit.",
+	})
+
+	configMapApplyErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tlc_configmap_apply_errors_total",
+		Help: "Total number of failed attempts to apply the generated ConfigMap.",
+	})
+
+	lastSuccessTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tlc_last_success_timestamp_seconds",
+		Help: "Unix timestamp of the last successful reconcile.",
+	})
+)
+
+// health tracks leader-election and reconcile state for the liveness and
+// readiness endpoints. Liveness (/healthz) must not depend on holding the
+// leader-election lease - a standby replica is working as intended and
+// should never be restarted for it - so only readiness (/readyz) gates on
+// reconcile staleness, and only once this replica is actually leading.
+type health struct {
+	mu             sync.Mutex
+	lastSuccess    time.Time
+	staleThreshold time.Duration
+	leading        bool
+}
+
+func newHealth(staleThreshold time.Duration) *health {
+	return &health{staleThreshold: staleThreshold}
+}
+
+func (h *health) recordSuccess(at time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastSuccess = at
+	lastSuccessTimestamp.Set(float64(at.Unix()))
+}
+
+// setLeading records whether this replica currently holds the
+// leader-election lease (always true when leader election is disabled).
+func (h *health) setLeading(leading bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.leading = leading
+}
+
+// livez reports process liveness only - it never fails because another
+// replica is leading, so Kubernetes never restarts a healthy standby.
+func (h *health) livez(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz reports whether this replica is actively reconciling within
+// staleThreshold. A standby replica (not currently leading) is always
+// reported ready, since it's intentionally idle rather than stuck.
+func (h *health) readyz(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	leading := h.leading
+	lastSuccess := h.lastSuccess
+	h.mu.Unlock()
+
+	if !leading {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "standby")
+		return
+	}
+
+	if lastSuccess.IsZero() {
+		http.Error(w, "no successful reconcile yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	if age := time.Since(lastSuccess); age > h.staleThreshold {
+		http.Error(w, fmt.Sprintf("last successful reconcile was %s ago, exceeding %s", age, h.staleThreshold), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+// serveMetrics starts the /metrics, /healthz (liveness) and /readyz
+// (reconcile-staleness readiness) HTTP server, and blocks until ctx is
+// cancelled.
+func serveMetrics(ctx context.Context, addr string, h *health) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", h.livez)
+	mux.HandleFunc("/readyz", h.readyz)
+
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	log.Infof("Serving /metrics and /healthz on %s", addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Errorf("metrics server exited with error: %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import "time"
+
+type CmdConfig struct {
+	ConfigMapName           string
+	ConfigMapLimitsPath     string
+	ConfigMapGeneratedName  string
+	ReceiverLabel           string
+	ActiveSeriesMax         int
+	ResyncPeriod            time.Duration
+	LeaderElect             bool
+	LeaderElectionLeaseName string
+	MetaMonitoringURL       string
+	MetaMonitoringQuery     string
+	TenantHeadroomRatio     float64
+	ListenAddr              string
+	DryRun                  bool
+	Diff                    bool
+}
+
+// https://thanos.io/tip/components/receive.md/#understanding-the-configuration-file
+// Take an existing configmap as an input, and override `write.default.head_series_limit`
+// (and, with a meta-monitoring URL set, each queried tenant's `head_series_limit`)
+type WriteConfig struct {
+	Write LimitsConfig `yaml:"write"`
+}
+
+type LimitsConfig struct {
+	Global  GlobalConfig             `yaml:"global"`
+	Default TenantConfig             `yaml:"default"`
+	Tenant  map[string]*TenantConfig `yaml:"tenants,omitempty"`
+}
+
+type GlobalConfig struct {
+	MaxConcurrency           *int   `yaml:"max_concurrency,omitempty"`
+	MetaMonitoringURL        string `yaml:"meta_monitoring_url"`
+	MetaMonitoringLimitQuery string `yaml:"meta_monitoring_limit_query"`
+}
+
+type TenantConfig struct {
+	Request         *RequestConfig `yaml:"request,omitempty"`
+	HeadSeriesLimit *int           `yaml:"head_series_limit,omitempty"`
+}
+
+type RequestConfig struct {
+	SizeBytesLimit *int `yaml:"size_bytes_limit,omitempty"`
+	SeriesLimit    *int `yaml:"series_limit,omitempty"`
+	SamplesLimit   *int `yaml:"samples_limit,omitempty"`
+}